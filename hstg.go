@@ -1,8 +1,13 @@
 package hstg
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"math"
+	"math/rand"
 )
 
 // binCodec is an interface used by an histogram
@@ -79,6 +84,126 @@ func (e *expCodec) decode(binValue uint) uint {
 	return uint(result)
 }
 
+///////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////
+//
+// logLinearCodec
+//
+///////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////
+
+// logLinearCodec is a codec that, for a value v, splits off its base-10
+// exponent and a two-digit mantissa, log-linear style (as used by the
+// Circonus circllhist scheme). Unlike expCodec, bin width grows with the
+// exponent instead of doubling every bin, which keeps relative error
+// bounded below 10% (decode reports a bin's lower edge) across the entire
+// dynamic range without the bin count blowing up.
+type logLinearCodec struct{}
+
+// newLogLinearCodec returns a valid new log-linear codec
+func newLogLinearCodec() (binCodec, error) {
+	return &logLinearCodec{}, nil
+}
+
+// encode is a binner function
+func (c *logLinearCodec) encode(value uint) uint {
+	if value == 0 {
+		return 0
+	}
+	valueF := float64(value)
+	exp := int(math.Floor(math.Log10(valueF)))
+	// guard against floating point error around exact powers of ten
+	for math.Pow(10, float64(exp)) > valueF {
+		exp--
+	}
+	for math.Pow(10, float64(exp+1)) <= valueF {
+		exp++
+	}
+	scale := math.Pow(10, float64(exp-1))
+	mantissa := uint(math.Floor(valueF/scale)) % 100
+	return uint(exp)*100 + mantissa
+}
+
+// decode is a binner function. It returns the lower edge of the bin
+func (c *logLinearCodec) decode(binValue uint) uint {
+	if binValue == 0 {
+		return 0
+	}
+	exp := binValue / 100
+	mantissa := binValue % 100
+	lowerEdge := float64(mantissa) / 10.0 * math.Pow(10, float64(exp))
+	return uint(lowerEdge)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////
+//
+// wire format
+//
+///////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////
+
+// hstgMagic identifies the binary wire format of a marshaled Hstg
+const hstgMagic = "HSTG"
+
+// hstgVersion is the version of the binary wire format written by this package
+const hstgVersion byte = 1
+
+// codec kind tags used in the binary wire format
+const (
+	codecKindDefault byte = iota
+	codecKindExp
+	codecKindLogLinear
+)
+
+// codecKind returns the wire tag for c and the single parameter (if any)
+// needed to reconstruct it
+func codecKind(c binCodec) (kind byte, param uint64, err error) {
+	switch cc := c.(type) {
+	case *defaultCodec:
+		return codecKindDefault, uint64(cc.binWidth), nil
+	case *expCodec:
+		return codecKindExp, uint64(cc.logBase), nil
+	case *logLinearCodec:
+		return codecKindLogLinear, 0, nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported codec type: %T", c)
+	}
+}
+
+// codecFromKind rebuilds a codec from a wire tag and its parameter
+func codecFromKind(kind byte, param uint64) (binCodec, error) {
+	switch kind {
+	case codecKindDefault:
+		return newDefaultCodec(uint(param))
+	case codecKindExp:
+		return newExpCodec(uint(param))
+	case codecKindLogLinear:
+		return newLogLinearCodec()
+	default:
+		return nil, fmt.Errorf("unknown codec kind: %d", kind)
+	}
+}
+
+// sameCodec reports whether a and b are the same concrete codec configured
+// with the same parameter, so that two histograms built from them bin
+// values identically and can be combined
+func sameCodec(a, b binCodec) bool {
+	switch ac := a.(type) {
+	case *defaultCodec:
+		bc, ok := b.(*defaultCodec)
+		return ok && ac.binWidth == bc.binWidth
+	case *expCodec:
+		bc, ok := b.(*expCodec)
+		return ok && ac.logBase == bc.logBase
+	case *logLinearCodec:
+		_, ok := b.(*logLinearCodec)
+		return ok
+	default:
+		return false
+	}
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 ///////////////////////////////////////////////////////////////////////////////
 //
@@ -87,16 +212,27 @@ func (e *expCodec) decode(binValue uint) uint {
 ///////////////////////////////////////////////////////////////////////////////
 ///////////////////////////////////////////////////////////////////////////////
 
-// hBin holds the bin size and its frequency. Also points to the next bin,
-// so ordered insertion can be O(1)
-type hBin struct {
-	value uint
-	freq  uint
-	next  *hBin
+// skipListMaxLevel bounds how tall a tower can grow. 32 levels comfortably
+// covers histograms with billions of distinct bins at skipListP = 0.25
+const skipListMaxLevel = 32
+
+// skipListP is the probability a tower grows one level taller
+const skipListP = 0.25
+
+// hBinLevel is one rung of a hBin's tower. span is the cumulative
+// frequency of every bin skipped by forward, including forward's own
+// frequency, which lets a descent compute a bin's rank without a
+// separate O(n) walk
+type hBinLevel struct {
+	forward *hBin
+	span    uint
 }
 
-func (b *hBin) update(freq uint) {
-	b.freq += freq
+// hBin holds a bin's value and frequency, plus its skip list tower
+type hBin struct {
+	value  uint
+	freq   uint
+	levels []hBinLevel
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -107,91 +243,184 @@ func (b *hBin) update(freq uint) {
 ///////////////////////////////////////////////////////////////////////////////
 ///////////////////////////////////////////////////////////////////////////////
 
-// hBinList holds a list of hBins
+// hBinList is a skip list of hBins keyed by value, so both Update (search
+// and insert) and Percentile (rank lookup) run in O(log n) instead of the
+// O(n) a plain sorted linked list requires
 type hBinList struct {
 	length    uint
 	totalFreq uint
+	level     int // number of levels currently in use, always >= 1
 	head      *hBin
-	curr      *hBin
 }
 
 func newBinList() *hBinList {
-	return &hBinList{}
+	return &hBinList{
+		level: 1,
+		head:  &hBin{levels: make([]hBinLevel, skipListMaxLevel)},
+	}
 }
 
 func (l *hBinList) iter(codec binCodec) *BinIter {
 	return newIter(l, codec)
 }
 
+// randomLevel draws the height of a newly inserted node's tower
+func randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// search walks the list top-down, filling update with, for every level,
+// the rightmost node whose value is less than value
+func (l *hBinList) search(value uint) (update [skipListMaxLevel]*hBin, rank [skipListMaxLevel]uint) {
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		if i == l.level-1 {
+			rank[i] = 0
+		} else {
+			rank[i] = rank[i+1]
+		}
+		for x.levels[i].forward != nil && x.levels[i].forward.value < value {
+			rank[i] += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		update[i] = x
+	}
+	return update, rank
+}
+
+// update finds the bin for value, creating it if necessary, and adds freq
+// to it
 func (l *hBinList) update(value, freq uint) {
+	update, rank := l.search(value)
 
-	if l.head == nil && l.curr != nil {
-		panic("current node of an empty list is non nil")
-
-	} else if l.curr == nil {
-		// always start from the head if there is not a current element defined
-		// even when the list is empty
-		bin := l.binFor(&l.head, value)
-		l.curr = bin // keep it
-		bin.update(freq)
-
-	} else if value < l.curr.value {
-		// when the value to be updated is less than the current element,
-		// we are passed its insertion point and we have to go back from the start
-		bin := l.binFor(&l.head, value)
-		l.curr = bin // keep it
-		bin.update(freq)
-
-	} else if value >= l.curr.value {
-		// if the update value is greater than or equal to the current element's value
-		// we pick up the search from the current element in order to ammortize the cost
-		// of the operation
-		bin := l.binFor(&l.curr, value)
-		l.curr = bin // keep it
-		bin.update(freq)
+	if next := update[0].levels[0].forward; next != nil && next.value == value {
+		for i := 0; i < l.level; i++ {
+			update[i].levels[i].span += freq
+		}
+		next.freq += freq
+		l.totalFreq += freq
+		return
+	}
 
-	} else {
-		panic("sentinel error: this else should not be reached")
+	level := randomLevel()
+	if level > l.level {
+		for i := l.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = l.head
+			update[i].levels[i].span = l.totalFreq
+		}
+		l.level = level
+	}
+
+	node := &hBin{value: value, freq: freq, levels: make([]hBinLevel, level)}
+	for i := 0; i < level; i++ {
+		node.levels[i].forward = update[i].levels[i].forward
+		update[i].levels[i].forward = node
+		node.levels[i].span = update[i].levels[i].span - (rank[0] - rank[i])
+		update[i].levels[i].span = (rank[0] - rank[i]) + freq
 	}
+	for i := level; i < l.level; i++ {
+		update[i].levels[i].span += freq
+	}
+
+	l.length++
 	l.totalFreq += freq
 }
 
-func (l *hBinList) binFor(head **hBin, value uint) *hBin {
-	var curr *hBin
-	for {
-		// either an empty list or the tail of a non-empty list
-		curr = *head
-		if curr == nil {
-			result := &hBin{value, 0, nil}
-			*head = result
-			l.length++
-			return result
+// subtract decreases the frequency of the bin for value by freq, saturating
+// at 0 rather than underflowing when freq is larger than the bin holds. If
+// the bin's frequency reaches 0 it is spliced out of the skip list entirely,
+// so length and BinCount stay accurate. It is a no-op if value has no bin
+func (l *hBinList) subtract(value, freq uint) {
+	update, _ := l.search(value)
+	next := update[0].levels[0].forward
+	if next == nil || next.value != value {
+		return
+	}
+	if freq > next.freq {
+		freq = next.freq
+	}
+	for i := 0; i < l.level; i++ {
+		update[i].levels[i].span -= freq
+	}
+	next.freq -= freq
+	l.totalFreq -= freq
+
+	if next.freq == 0 {
+		l.remove(update, next)
+	}
+}
+
+// remove splices node out of every level its tower occupies, folding its
+// (already zero) contribution into its predecessor's span, and shrinks
+// l.level if that emptied out the topmost levels
+func (l *hBinList) remove(update [skipListMaxLevel]*hBin, node *hBin) {
+	for i := 0; i < len(node.levels); i++ {
+		update[i].levels[i].span += node.levels[i].span
+		update[i].levels[i].forward = node.levels[i].forward
+	}
+	for l.level > 1 && l.head.levels[l.level-1].forward == nil {
+		l.level--
+	}
+	l.length--
+}
+
+// rank returns the cumulative frequency of every bin strictly less than
+// value, in O(log n)
+func (l *hBinList) rank(value uint) uint {
+	x := l.head
+	var acc uint
+	for i := l.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && x.levels[i].forward.value < value {
+			acc += x.levels[i].span
+			x = x.levels[i].forward
 		}
-		if curr.value == value { // there is already an element with the given value
-			return curr
-		} else if curr.value < value { // haven't found the spot yet
-			head = &curr.next
-			continue
+	}
+	return acc
+}
+
+// findByPRank returns the bin with the greatest value whose percentile
+// rank (the cumulative frequency of every lesser bin, over totalFreq) does
+// not exceed prank, descending the skip list top-down in O(log n)
+func (l *hBinList) findByPRank(prank float64) *hBin {
+	x := l.head
+	var acc uint
+	for i := l.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil {
+			candidate := x.levels[i].forward
+			candidateAcc := acc + x.levels[i].span
+			exclusivePRank := float64(candidateAcc-candidate.freq) / float64(l.totalFreq) * 100.0
+			if exclusivePRank > prank {
+				break
+			}
+			x = candidate
+			acc = candidateAcc
 		}
-		// we passed the spot. Go back one
-		break
 	}
-	result := &hBin{value, 0, curr}
-	*head = result
-	l.length++
-	return result
+	return x
 }
 
 func (l *hBinList) first() *hBin {
-	return l.head
+	return l.head.levels[0].forward
 }
 
+// last descends from the top level, always taking the rightmost available
+// hop, landing on the greatest bin in O(log n)
 func (l *hBinList) last() *hBin {
-	bin := l.head
-	for bin != nil && bin.next != nil {
-		bin = bin.next
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil {
+			x = x.levels[i].forward
+		}
 	}
-	return bin
+	if x == l.head {
+		return nil
+	}
+	return x
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -206,16 +435,11 @@ func (l *hBinList) last() *hBin {
 type BinIter struct {
 	binList *hBinList
 	curr    *hBin
-	cumFreq uint
 	codec   binCodec
 }
 
 func newIter(binList *hBinList, codec binCodec) *BinIter {
-	return &BinIter{binList, binList.head, 0, codec}
-}
-
-func (i *BinIter) bin() *hBin {
-	return i.curr
+	return &BinIter{binList, binList.first(), codec}
 }
 
 // Done indicates wheter the iteration has finished
@@ -225,8 +449,7 @@ func (i *BinIter) Done() bool {
 
 // Next positions the iterator on the next bin
 func (i *BinIter) Next() {
-	i.cumFreq += i.curr.freq
-	i.curr = i.curr.next
+	i.curr = i.curr.levels[0].forward
 }
 
 // Freq returns the bin frequency
@@ -234,9 +457,11 @@ func (i *BinIter) Freq() uint {
 	return i.curr.freq
 }
 
-// PRank returns the percentile rank for the current bin
+// PRank returns the percentile rank for the current bin. It is derived
+// from the skip list's towers on demand instead of a running sum kept by
+// the iterator
 func (i *BinIter) PRank() float64 {
-	return (float64(i.cumFreq) / float64(i.binList.totalFreq)) * 100.0
+	return (float64(i.binList.rank(i.curr.value)) / float64(i.binList.totalFreq)) * 100.0
 }
 
 // Percentile returns the percentile associated with the lower bound of the current bin
@@ -276,6 +501,17 @@ func NewExp(logBase uint) (*Hstg, error) {
 	return &Hstg{codec, newBinList()}, nil
 }
 
+// NewLogLinear returns a histogram using a log-linear, base-10 codec ready
+// for use. It trades a larger bin count for a worst-case relative error
+// bounded below 10% across the whole dynamic range
+func NewLogLinear() (*Hstg, error) {
+	codec, err := newLogLinearCodec()
+	if err != nil {
+		return nil, err
+	}
+	return &Hstg{codec, newBinList()}, nil
+}
+
 // BinCount returns the current number of bins in the histogram
 func (h *Hstg) BinCount() uint {
 	return h.binList.length
@@ -287,7 +523,7 @@ func (h *Hstg) TotalFreq() uint {
 }
 
 // Update will find the right bin and update its frequency
-// This operation is O(n) with ammortization for monotonically increasing values
+// This operation is O(log n), regardless of insertion order
 func (h *Hstg) Update(value uint) {
 	binValue := h.codec.encode(value)
 	h.binList.update(binValue, 1)
@@ -297,7 +533,7 @@ func (h *Hstg) Update(value uint) {
 // the percentile of the underlying grouped data
 // An error is returned if the percentile is not within the range [0.0, 1.0].
 // 0 is returned when the histogram is empty
-// This operation is O(n) with no ammortization
+// This operation is O(log n), descending the underlying skip list
 func (h *Hstg) Percentile(prank float64) (uint, error) {
 	var bin *hBin
 
@@ -317,15 +553,7 @@ func (h *Hstg) Percentile(prank float64) (uint, error) {
 		bin = h.binList.last()
 
 	} else {
-		i := h.binList.iter(h.codec)
-		bin = i.bin()
-		for !i.Done() {
-			if i.PRank() > prank {
-				break
-			}
-			bin = i.bin()
-			i.Next()
-		}
+		bin = h.binList.findByPRank(prank)
 	}
 
 	result := h.codec.decode(bin.value)
@@ -336,3 +564,151 @@ func (h *Hstg) Percentile(prank float64) (uint, error) {
 func (h *Hstg) Iter() *BinIter {
 	return newIter(h.binList, h.codec)
 }
+
+// Merge folds other's bins into h, summing per-bin frequencies. An error
+// is returned if h and other were not built with the same codec
+func (h *Hstg) Merge(other *Hstg) error {
+	if !sameCodec(h.codec, other.codec) {
+		return fmt.Errorf("cannot merge histograms built with different codecs")
+	}
+	for bin := other.binList.first(); bin != nil; bin = bin.levels[0].forward {
+		h.binList.update(bin.value, bin.freq)
+	}
+	return nil
+}
+
+// Add is an alias for Merge, kept for symmetry with Sub
+func (h *Hstg) Add(other *Hstg) error {
+	return h.Merge(other)
+}
+
+// Sub removes other's bins from h, subtracting per-bin frequencies and
+// saturating at 0 for any bin that would otherwise go negative. An error
+// is returned if h and other were not built with the same codec
+func (h *Hstg) Sub(other *Hstg) error {
+	if !sameCodec(h.codec, other.codec) {
+		return fmt.Errorf("cannot subtract histograms built with different codecs")
+	}
+	for bin := other.binList.first(); bin != nil; bin = bin.levels[0].forward {
+		h.binList.subtract(bin.value, bin.freq)
+	}
+	return nil
+}
+
+// Clone returns an independent copy of h, so callers can snapshot it
+// before resetting and continuing to update the original
+func (h *Hstg) Clone() *Hstg {
+	clone := &Hstg{h.codec, newBinList()}
+	for bin := h.binList.first(); bin != nil; bin = bin.levels[0].forward {
+		clone.binList.update(bin.value, bin.freq)
+	}
+	return clone
+}
+
+// Reset discards every bin in h, leaving it empty and ready for reuse
+func (h *Hstg) Reset() {
+	h.binList = newBinList()
+}
+
+// MarshalBinary encodes h as a short header (magic, version, codec kind
+// and parameter) followed by its sorted (binValue, freq) pairs, all as
+// uvarints, so histograms can be persisted or shipped between processes
+func (h *Hstg) MarshalBinary() ([]byte, error) {
+	kind, param, err := codecKind(h.codec)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(hstgMagic)
+	buf.WriteByte(hstgVersion)
+	buf.WriteByte(kind)
+
+	scratch := make([]byte, binary.MaxVarintLen64)
+	writeUvarint := func(v uint64) {
+		n := binary.PutUvarint(scratch, v)
+		buf.Write(scratch[:n])
+	}
+	writeUvarint(param)
+	writeUvarint(uint64(h.binList.length))
+	for bin := h.binList.first(); bin != nil; bin = bin.levels[0].forward {
+		writeUvarint(uint64(bin.value))
+		writeUvarint(uint64(bin.freq))
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a payload produced by MarshalBinary into h,
+// replacing its codec and bins
+func (h *Hstg) UnmarshalBinary(data []byte) error {
+	if len(data) < len(hstgMagic)+2 || string(data[:len(hstgMagic)]) != hstgMagic {
+		return fmt.Errorf("invalid hstg binary payload: missing magic bytes")
+	}
+	r := bytes.NewReader(data[len(hstgMagic):])
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != hstgVersion {
+		return fmt.Errorf("unsupported hstg wire version: %d", version)
+	}
+
+	kind, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	param, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	codec, err := codecFromKind(kind, param)
+	if err != nil {
+		return err
+	}
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	binList := newBinList()
+	for i := uint64(0); i < count; i++ {
+		value, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		freq, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		binList.update(uint(value), uint(freq))
+	}
+
+	h.codec = codec
+	h.binList = binList
+	return nil
+}
+
+// MarshalJSON encodes h as a JSON string holding the base64 of its
+// MarshalBinary form, following the convention used by circllhist so
+// operators recognize histogram payloads in scrape output
+func (h *Hstg) MarshalJSON() ([]byte, error) {
+	data, err := h.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(data))
+}
+
+// UnmarshalJSON decodes a payload produced by MarshalJSON into h
+func (h *Hstg) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	return h.UnmarshalBinary(raw)
+}
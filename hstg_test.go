@@ -1,6 +1,7 @@
 package hstg
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -83,39 +84,82 @@ func TestItEncodesAndDecodesValuesWithAExpEncoder(t *testing.T) {
 
 }
 
+func TestItEncodesAndDecodesValuesWithALogLinearEncoder(t *testing.T) {
+
+	h, err := newLogLinearCodec()
+	require.Nilf(t, err, "an error was returned when creating a log-linear codec: %s", err)
+	require.NotNil(t, h, "nil newLogLinearCodec returned")
+
+	table := [][]uint{
+		[]uint{0, 0, 0},
+		[]uint{1, 10, 1},
+		[]uint{9, 90, 9},
+		[]uint{10, 110, 10},
+		[]uint{99, 199, 99},
+		[]uint{100, 210, 100},
+		[]uint{12345, 412, 12000},
+	}
+	for i := 0; i < len(table); i++ {
+		actual := h.encode(table[i][0])
+		require.Equalf(t, table[i][1], actual, "encode error i = %d", i)
+		actual = h.decode(table[i][1])
+		require.Equalf(t, table[i][2], actual, "decode error i = %d", i)
+	}
+}
+
+// findBin walks list from the front looking for a bin with the given
+// value, returning nil if there is none
+func findBin(list *hBinList, value uint) *hBin {
+	for bin := list.first(); bin != nil; bin = bin.levels[0].forward {
+		if bin.value == value {
+			return bin
+		}
+	}
+	return nil
+}
+
 func TestItUpdatesTheBinList(t *testing.T) {
 	list := newBinList()
 
 	list.update(5, 1)
 	require.Equalf(t, uint(1), list.totalFreq, "update error during empty insertion")
 	require.Equalf(t, uint(1), list.length, "update error during empty insertion")
-	require.Equalf(t, uint(5), list.curr.value, "update error during empty insertion")
-	require.Equalf(t, uint(1), list.curr.freq, "update error during empty insertion")
+	require.Equalf(t, uint(1), findBin(list, 5).freq, "update error during empty insertion")
 
 	list.update(3, 1)
 	require.Equalf(t, uint(2), list.totalFreq, "update error during head insertion")
 	require.Equalf(t, uint(2), list.length, "update error during head insertion")
-	require.Equalf(t, uint(3), list.curr.value, "update error during head insertion")
-	require.Equalf(t, uint(1), list.curr.freq, "update error during head insertion")
+	require.Equalf(t, uint(1), findBin(list, 3).freq, "update error during head insertion")
 
 	list.update(7, 1)
 	require.Equalf(t, uint(3), list.totalFreq, "update error during tail insertion")
 	require.Equalf(t, uint(3), list.length, "update error during tail insertion")
-	require.Equalf(t, uint(7), list.curr.value, "update error during tail insertion")
-	require.Equalf(t, uint(1), list.curr.freq, "update error during tail insertion")
+	require.Equalf(t, uint(1), findBin(list, 7).freq, "update error during tail insertion")
 
 	list.update(6, 1)
 	require.Equalf(t, uint(4), list.totalFreq, "update error during middle insertion")
 	require.Equalf(t, uint(4), list.length, "update error during middle insertion")
-	require.Equalf(t, uint(6), list.curr.value, "update error during middle insertion")
-	require.Equalf(t, uint(1), list.curr.freq, "update error during middle insertion")
+	require.Equalf(t, uint(1), findBin(list, 6).freq, "update error during middle insertion")
 
 	list.update(5, 2)
-	require.Equalf(t, uint(4+2), list.totalFreq, "update error during existing search") // total freq is updated by 2
-	require.Equalf(t, uint(4+0), list.length, "update error during existing search")    // list size does not increase
-	require.Equalf(t, uint(5), list.curr.value, "update error during existing search")
-	require.Equalf(t, uint(1+2), list.curr.freq, "update error during existing search") // bin freq is updated by 2
+	require.Equalf(t, uint(4+2), list.totalFreq, "update error during existing search")        // total freq is updated by 2
+	require.Equalf(t, uint(4+0), list.length, "update error during existing search")           // list size does not increase
+	require.Equalf(t, uint(1+2), findBin(list, 5).freq, "update error during existing search") // bin freq is updated by 2
 
+	require.Equalf(t, []uint{3, 5, 6, 7}, []uint{list.first().value, findBin(list, 5).value, findBin(list, 6).value, list.last().value}, "update error: list is not kept in sorted order")
+}
+
+func TestItRanksBinsInTheSkipList(t *testing.T) {
+	list := newBinList()
+	for _, v := range []uint{1, 2, 3, 4, 5} {
+		list.update(v, v*v)
+	}
+
+	require.Equalf(t, uint(0), list.rank(1), "rank error: nothing precedes the smallest bin")
+	require.Equalf(t, uint(1), list.rank(2), "rank error: unexpected cumulative frequency")
+	require.Equalf(t, uint(1+2*2), list.rank(3), "rank error: unexpected cumulative frequency")
+	require.Equalf(t, uint(1+2*2+3*3), list.rank(4), "rank error: unexpected cumulative frequency")
+	require.Equalf(t, uint(1+2*2+3*3+4*4), list.rank(5), "rank error: unexpected cumulative frequency")
 }
 
 func TestItIteratesOverBins(t *testing.T) {
@@ -170,3 +214,171 @@ func testItComputesPercentiles(t *testing.T) {
 		}
 	}
 }
+
+func TestItMergesTwoHistograms(t *testing.T) {
+	a, _ := New(1)
+	b, _ := New(1)
+
+	for _, v := range []uint{1, 2, 3} {
+		a.Update(v)
+	}
+	for _, v := range []uint{2, 3, 4} {
+		b.Update(v)
+	}
+
+	err := a.Merge(b)
+	require.Nilf(t, err, "an error was returned when merging two histograms sharing the same codec: %s", err)
+	require.Equalf(t, uint(6), a.TotalFreq(), "merge error: unexpected total frequency")
+	require.Equalf(t, uint(4), a.BinCount(), "merge error: unexpected bin count")
+
+	c, _ := NewExp(2)
+	err = a.Merge(c)
+	require.Errorf(t, err, "an error was not raised when merging histograms with different codecs")
+}
+
+func TestItAddsAndSubtractsHistograms(t *testing.T) {
+	a, _ := New(1)
+	b, _ := New(1)
+
+	for _, v := range []uint{1, 1, 2} {
+		a.Update(v)
+	}
+	for _, v := range []uint{1, 2} {
+		b.Update(v)
+	}
+
+	err := a.Add(b)
+	require.Nilf(t, err, "an error was returned when adding two histograms sharing the same codec: %s", err)
+	require.Equalf(t, uint(5), a.TotalFreq(), "add error: unexpected total frequency")
+
+	err = a.Sub(b)
+	require.Nilf(t, err, "an error was returned when subtracting two histograms sharing the same codec: %s", err)
+	require.Equalf(t, uint(3), a.TotalFreq(), "sub error: unexpected total frequency")
+
+	// subtracting more than a bin holds saturates at 0 instead of underflowing
+	err = a.Sub(a.Clone())
+	require.Nilf(t, err, "an error was returned when subtracting a clone from itself: %s", err)
+	err = a.Sub(b)
+	require.Nilf(t, err, "an error was returned when subtracting below 0: %s", err)
+	require.Equalf(t, uint(0), a.TotalFreq(), "sub error: frequency underflowed instead of saturating at 0")
+
+	// draining every bin to 0 must remove them, not just zero them out,
+	// or BinCount/Percentile keep reporting a non-empty histogram
+	require.Equalf(t, uint(0), a.BinCount(), "sub error: drained bins were not removed from the histogram")
+	for _, prank := range []float64{0, 25, 50, 75, 100} {
+		p, err := a.Percentile(prank)
+		require.Nilf(t, err, "an error was returned computing the percentile of a drained histogram: %s", err)
+		require.Equalf(t, uint(0), p, "percentile error: a drained histogram must report 0 at every prank")
+	}
+}
+
+// requireSameBins walks a and b's bin lists in lockstep and asserts every
+// (value, freq) pair matches, so round-trip tests catch a bin-level drift
+// that aggregate checks like TotalFreq/BinCount/Percentile could miss
+func requireSameBins(t *testing.T, a, b *Hstg) {
+	t.Helper()
+	binA, binB := a.binList.first(), b.binList.first()
+	for binA != nil && binB != nil {
+		require.Equalf(t, binA.value, binB.value, "round trip error: bin value mismatch")
+		require.Equalf(t, binA.freq, binB.freq, "round trip error: bin frequency mismatch for value %v", binA.value)
+		binA = binA.levels[0].forward
+		binB = binB.levels[0].forward
+	}
+	require.Nilf(t, binA, "round trip error: a has more bins than b")
+	require.Nilf(t, binB, "round trip error: b has more bins than a")
+}
+
+func TestItRoundTripsThroughBinaryMarshaling(t *testing.T) {
+	h, _ := NewExp(2)
+	for _, v := range []uint{1, 2, 3, 7, 15, 100, 1000} {
+		h.Update(v)
+	}
+
+	data, err := h.MarshalBinary()
+	require.Nilf(t, err, "an error was returned when marshaling a histogram to binary: %s", err)
+
+	other, _ := New(1) // deliberately mismatched codec, UnmarshalBinary must replace it
+	err = other.UnmarshalBinary(data)
+	require.Nilf(t, err, "an error was returned when unmarshaling a histogram from binary: %s", err)
+
+	require.Equalf(t, h.TotalFreq(), other.TotalFreq(), "round trip error: unexpected total frequency")
+	require.Equalf(t, h.BinCount(), other.BinCount(), "round trip error: unexpected bin count")
+	requireSameBins(t, h, other)
+
+	for _, prank := range []float64{0, 10, 25, 50, 75, 90, 100} {
+		expected, _ := h.Percentile(prank)
+		actual, _ := other.Percentile(prank)
+		require.Equalf(t, expected, actual, "round trip error: percentile mismatch at prank %v", prank)
+	}
+}
+
+func TestItRoundTripsThroughJSONMarshaling(t *testing.T) {
+	h, _ := NewLogLinear()
+	for _, v := range []uint{1, 9, 10, 99, 100, 12345} {
+		h.Update(v)
+	}
+
+	data, err := json.Marshal(h)
+	require.Nilf(t, err, "an error was returned when marshaling a histogram to JSON: %s", err)
+
+	other := &Hstg{}
+	err = json.Unmarshal(data, other)
+	require.Nilf(t, err, "an error was returned when unmarshaling a histogram from JSON: %s", err)
+
+	require.Equalf(t, h.TotalFreq(), other.TotalFreq(), "round trip error: unexpected total frequency")
+	require.Equalf(t, h.BinCount(), other.BinCount(), "round trip error: unexpected bin count")
+	requireSameBins(t, h, other)
+
+	for _, prank := range []float64{0, 10, 25, 50, 75, 90, 100} {
+		expected, _ := h.Percentile(prank)
+		actual, _ := other.Percentile(prank)
+		require.Equalf(t, expected, actual, "round trip error: percentile mismatch at prank %v", prank)
+	}
+}
+
+func TestItClonesAndResetsAHistogram(t *testing.T) {
+	h, _ := New(1)
+	for _, v := range []uint{1, 2, 3} {
+		h.Update(v)
+	}
+
+	clone := h.Clone()
+	require.Equalf(t, h.TotalFreq(), clone.TotalFreq(), "clone error: unexpected total frequency")
+	require.Equalf(t, h.BinCount(), clone.BinCount(), "clone error: unexpected bin count")
+
+	h.Update(4)
+	require.NotEqualf(t, h.TotalFreq(), clone.TotalFreq(), "clone error: clone was not independent of the original")
+
+	h.Reset()
+	require.Equalf(t, uint(0), h.TotalFreq(), "reset error: unexpected total frequency")
+	require.Equalf(t, uint(0), h.BinCount(), "reset error: unexpected bin count")
+}
+
+// benchmarkUpdateAndPercentile builds a histogram with distinctBins
+// distinct bin values, then measures the cost of an Update/Percentile pair
+// against it. A bin width of 1 is used so that every value inserted gets a
+// bin of its own
+func benchmarkUpdateAndPercentile(b *testing.B, distinctBins int) {
+	h, _ := New(1)
+	for i := 0; i < distinctBins; i++ {
+		h.Update(uint(i + 1))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Update(uint(i%distinctBins) + 1)
+		h.Percentile(50)
+	}
+}
+
+func BenchmarkUpdateAndPercentile10(b *testing.B) {
+	benchmarkUpdateAndPercentile(b, 10)
+}
+
+func BenchmarkUpdateAndPercentile1k(b *testing.B) {
+	benchmarkUpdateAndPercentile(b, 1000)
+}
+
+func BenchmarkUpdateAndPercentile100k(b *testing.B) {
+	benchmarkUpdateAndPercentile(b, 100000)
+}
@@ -0,0 +1,89 @@
+package hstg
+
+import (
+	"sync"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////
+//
+// SafeHstg
+//
+///////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////
+
+// SafeHstg wraps an Hstg with a sync.RWMutex so it can be shared across
+// goroutines. hBinList.update mutates the underlying skip list in place,
+// so concurrent Updates on a bare Hstg would race
+type SafeHstg struct {
+	mu sync.RWMutex
+	h  *Hstg
+}
+
+// NewSafe wraps h for concurrent use. h must not be updated directly, or
+// through another wrapper, once passed here
+func NewSafe(h *Hstg) *SafeHstg {
+	return &SafeHstg{h: h}
+}
+
+// Update finds the right bin and updates its frequency
+func (s *SafeHstg) Update(value uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.h.Update(value)
+}
+
+// BatchUpdate updates the histogram with every value in values, taking
+// the lock only once instead of once per value. The underlying skip list
+// is O(log n) regardless of insertion order, so values are inserted as given
+func (s *SafeHstg) BatchUpdate(values []uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, value := range values {
+		s.h.Update(value)
+	}
+}
+
+// Percentile receives a float between 0.0 and 100.0 and it computes the
+// percentile of the underlying grouped data
+func (s *SafeHstg) Percentile(prank float64) (uint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h.Percentile(prank)
+}
+
+// Merge folds other's bins into s, summing per-bin frequencies. other is
+// snapshotted under its own lock before s is locked, so this never holds
+// two SafeHstgs' locks at once - doing so would deadlock on s.Merge(s)
+// and on two SafeHstgs merging into each other concurrently
+func (s *SafeHstg) Merge(other *SafeHstg) error {
+	other.mu.RLock()
+	snapshot := other.h.Clone()
+	other.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.h.Merge(snapshot)
+}
+
+// Iter returns an iterator over a point-in-time snapshot of the
+// histogram's bins, so callers can range over it without holding the lock
+func (s *SafeHstg) Iter() *BinIter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h.Clone().Iter()
+}
+
+// TotalFreq returns the number of entries in the histogram
+func (s *SafeHstg) TotalFreq() uint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h.TotalFreq()
+}
+
+// BinCount returns the current number of bins in the histogram
+func (s *SafeHstg) BinCount() uint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h.BinCount()
+}
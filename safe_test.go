@@ -0,0 +1,93 @@
+package hstg
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestItUpdatesSafelyFromManyGoroutines(t *testing.T) {
+	h, _ := New(1)
+	safe := NewSafe(h)
+
+	const goroutines = 20
+	const updatesPerGoroutine = 500
+
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func(seed uint) {
+			defer wg.Done()
+			for i := uint(0); i < updatesPerGoroutine; i++ {
+				safe.Update((seed + i) % 100)
+			}
+		}(uint(g))
+	}
+	wg.Wait()
+
+	require.Equalf(t, uint(goroutines*updatesPerGoroutine), safe.TotalFreq(), "race error: unexpected total frequency")
+}
+
+func TestItBatchUpdatesSafelyFromManyGoroutines(t *testing.T) {
+	h, _ := New(1)
+	safe := NewSafe(h)
+
+	const goroutines = 10
+	const batchSize = 200
+
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func(seed uint) {
+			defer wg.Done()
+			batch := make([]uint, batchSize)
+			for i := range batch {
+				batch[i] = (seed + uint(i)) % 50
+			}
+			safe.BatchUpdate(batch)
+		}(uint(g))
+	}
+	wg.Wait()
+
+	require.Equalf(t, uint(goroutines*batchSize), safe.TotalFreq(), "race error: unexpected total frequency")
+}
+
+// TestItMergesSafelyFromManyGoroutines guards against lock-order-inversion
+// deadlocks in SafeHstg.Merge: goroutines merge into each other's
+// histograms, and one merges a histogram into itself, all concurrently
+func TestItMergesSafelyFromManyGoroutines(t *testing.T) {
+	ha, _ := New(1)
+	hb, _ := New(1)
+	a := NewSafe(ha)
+	b := NewSafe(hb)
+
+	for i := uint(0); i < 10; i++ {
+		a.Update(i)
+		b.Update(i)
+	}
+
+	const rounds = 200
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			require.NoError(t, a.Merge(b))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			require.NoError(t, b.Merge(a))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			require.NoError(t, a.Merge(a))
+		}
+	}()
+	wg.Wait()
+}